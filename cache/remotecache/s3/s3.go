@@ -3,10 +3,15 @@ package s3
 import (
 	"bytes"
 	"context"
+	"crypto/md5" //nolint:gosec // required by the S3 SSE-C API, not used for security purposes
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -14,9 +19,11 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	aws_config "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/containerd/containerd/v2/core/content"
 	"github.com/containerd/containerd/v2/pkg/labels"
 	"github.com/moby/buildkit/cache/remotecache"
@@ -33,36 +40,104 @@ import (
 )
 
 const (
-	attrBucket            = "bucket"
-	attrRegion            = "region"
-	attrPrefix            = "prefix"
-	attrManifestsPrefix   = "manifests_prefix"
-	attrBlobsPrefix       = "blobs_prefix"
-	attrName              = "name"
-	attrTouchRefresh      = "touch_refresh"
-	attrEndpointURL       = "endpoint_url"
-	attrAccessKeyID       = "access_key_id"
-	attrSecretAccessKey   = "secret_access_key"
-	attrSessionToken      = "session_token"
-	attrUsePathStyle      = "use_path_style"
-	attrUploadParallelism = "upload_parallelism"
-	maxCopyObjectSize     = 5 * 1024 * 1024 * 1024
+	attrBucket                = "bucket"
+	attrRegion                = "region"
+	attrPrefix                = "prefix"
+	attrManifestsPrefix       = "manifests_prefix"
+	attrBlobsPrefix           = "blobs_prefix"
+	attrName                  = "name"
+	attrTouchRefresh          = "touch_refresh"
+	attrEndpointURL           = "endpoint_url"
+	attrAccessKeyID           = "access_key_id"
+	attrSecretAccessKey       = "secret_access_key"
+	attrSessionToken          = "session_token"
+	attrUsePathStyle          = "use_path_style"
+	attrUploadParallelism     = "upload_parallelism"
+	attrDownloadParallelism   = "download_parallelism"
+	attrPartSize              = "part_size"
+	attrSSE                   = "sse"
+	attrSSEKMSKeyID           = "sse_kms_key_id"
+	attrSSECustomerAlgo       = "sse_customer_algorithm"
+	attrSSECustomerKey        = "sse_customer_key"
+	attrBucketKeyEnabled      = "bucket_key_enabled"
+	attrStorageClass          = "storage_class"
+	attrBlobsStorageClass     = "blobs_storage_class"
+	attrManifestStorageClass  = "manifest_storage_class"
+	attrObjectTags            = "object_tags"
+	attrManifestMode          = "manifest_mode"
+	attrImportManifestVersion = "import_manifest_version"
+	attrManifestHistoryKeep   = "manifest_history_keep"
+	attrRoleARN               = "role_arn"
+	attrRoleSessionName       = "role_session_name"
+	attrExternalID            = "external_id"
+	attrWebIdentityTokenFile  = "web_identity_token_file"
+	attrProfile               = "profile"
+	attrChecksum              = "checksum"
+	attrProvider              = "provider"
+	attrDisableContentMD5     = "disable_content_md5"
+	maxCopyObjectSize         = 5 * 1024 * 1024 * 1024
+
+	manifestModeVersioned  = "versioned"
+	manifestCurrentKey     = "CURRENT"
+	credentialsRefreshTick = 15 * time.Minute
+
+	providerAWS          = "aws"
+	providerMinIO        = "minio"
+	providerCeph         = "ceph"
+	providerCloudflareR2 = "cloudflare-r2"
+	providerGCSHMAC      = "gcs-hmac"
+	providerOther        = "other"
 )
 
 type Config struct {
-	Bucket            string
-	Region            string
-	Prefix            string
-	ManifestsPrefix   string
-	BlobsPrefix       string
-	Names             []string
-	TouchRefresh      time.Duration
-	EndpointURL       string
-	AccessKeyID       string
-	SecretAccessKey   string
-	SessionToken      string
-	UsePathStyle      bool
-	UploadParallelism int
+	Bucket                string
+	Region                string
+	Prefix                string
+	ManifestsPrefix       string
+	BlobsPrefix           string
+	Names                 []string
+	TouchRefresh          time.Duration
+	EndpointURL           string
+	AccessKeyID           string
+	SecretAccessKey       string
+	SessionToken          string
+	UsePathStyle          bool
+	UploadParallelism     int
+	SSE                   string
+	SSEKMSKeyID           string
+	SSECustomerAlgo       string
+	SSECustomerKey        string
+	SSECustomerKeyMD5     string
+	BucketKeyEnabled      bool
+	BlobsStorageClass     string
+	ManifestStorageClass  string
+	ObjectTags            string
+	ManifestMode          string
+	ImportManifestVersion string
+	ManifestHistoryKeep   int
+	DownloadParallelism   int
+	PartSize              int64
+	RoleARN               string
+	RoleSessionName       string
+	ExternalID            string
+	WebIdentityTokenFile  string
+	Profile               string
+	Checksum              string
+	Provider              string
+	DisableContentMD5     bool
+}
+
+// defaultChecksumForProvider returns the checksum default for a provider when
+// the checksum attribute is unset. Not every S3-compatible backend supports
+// the chunked-trailer checksum upload, so only real AWS S3 (including the
+// empty/unset provider, which targets AWS by default) gets it for free.
+func defaultChecksumForProvider(provider string) string {
+	switch provider {
+	case "", providerAWS:
+		return "sha256"
+	default:
+		return "off"
+	}
 }
 
 func getConfig(attrs map[string]string) (Config, error) {
@@ -118,7 +193,14 @@ func getConfig(attrs map[string]string) (Config, error) {
 	secretAccessKey := attrs[attrSecretAccessKey]
 	sessionToken := attrs[attrSessionToken]
 
-	usePathStyle := false
+	provider := attrs[attrProvider]
+	switch provider {
+	case "", providerAWS, providerMinIO, providerCeph, providerCloudflareR2, providerGCSHMAC, providerOther:
+	default:
+		return Config{}, errors.Errorf("provider must be one of %q, %q, %q, %q, %q, %q or empty", providerAWS, providerMinIO, providerCeph, providerCloudflareR2, providerGCSHMAC, providerOther)
+	}
+
+	usePathStyle := provider == providerMinIO || provider == providerCeph || provider == providerOther
 	usePathStyleStr, ok := attrs[attrUsePathStyle]
 	if ok {
 		usePathStyleUser, err := strconv.ParseBool(usePathStyleStr)
@@ -127,6 +209,15 @@ func getConfig(attrs map[string]string) (Config, error) {
 		}
 	}
 
+	disableContentMD5 := false
+	disableContentMD5Str, ok := attrs[attrDisableContentMD5]
+	if ok {
+		disableContentMD5User, err := strconv.ParseBool(disableContentMD5Str)
+		if err == nil {
+			disableContentMD5 = disableContentMD5User
+		}
+	}
+
 	uploadParallelism := 4
 	uploadParallelismStr, ok := attrs[attrUploadParallelism]
 	if ok {
@@ -140,20 +231,150 @@ func getConfig(attrs map[string]string) (Config, error) {
 		uploadParallelism = uploadParallelismInt
 	}
 
+	downloadParallelism := 4
+	downloadParallelismStr, ok := attrs[attrDownloadParallelism]
+	if ok {
+		downloadParallelismInt, err := strconv.Atoi(downloadParallelismStr)
+		if err != nil || downloadParallelismInt <= 0 {
+			return Config{}, errors.Errorf("download_parallelism must be a positive integer")
+		}
+		downloadParallelism = downloadParallelismInt
+	}
+
+	partSize := int64(manager.DefaultDownloadPartSize)
+	partSizeStr, ok := attrs[attrPartSize]
+	if ok {
+		partSizeInt, err := strconv.ParseInt(partSizeStr, 10, 64)
+		if err != nil || partSizeInt <= 0 {
+			return Config{}, errors.Errorf("part_size must be a positive integer")
+		}
+		partSize = partSizeInt
+	}
+
+	roleARN := attrs[attrRoleARN]
+	roleSessionName := attrs[attrRoleSessionName]
+	if roleSessionName == "" {
+		roleSessionName = "buildkit"
+	}
+	externalID := attrs[attrExternalID]
+	webIdentityTokenFile := attrs[attrWebIdentityTokenFile]
+	profile := attrs[attrProfile]
+
+	checksum := attrs[attrChecksum]
+	switch checksum {
+	case "":
+		// Additional checksums default on for real AWS S3, which always supports
+		// the chunked-trailer checksum upload. Defaulting to on for other
+		// S3-compatible backends would be backward-incompatible, since not all
+		// of them support it; leave it opt-in there (see defaultChecksumForProvider).
+		checksum = defaultChecksumForProvider(provider)
+	case "sha256", "crc32c", "off":
+	default:
+		return Config{}, errors.Errorf("checksum must be one of %q, %q, %q or empty", "sha256", "crc32c", "off")
+	}
+
+	sse := attrs[attrSSE]
+	switch sse {
+	case "", "AES256", "aws:kms":
+	default:
+		return Config{}, errors.Errorf("sse must be one of %q, %q or empty", "AES256", "aws:kms")
+	}
+
+	sseKMSKeyID := attrs[attrSSEKMSKeyID]
+	sseCustomerAlgo := attrs[attrSSECustomerAlgo]
+	sseCustomerKey := attrs[attrSSECustomerKey]
+
+	if sse != "" && sseCustomerKey != "" {
+		return Config{}, errors.Errorf("sse and sse_customer_key are mutually exclusive")
+	}
+
+	var sseCustomerKeyMD5 string
+	if sseCustomerKey != "" {
+		if sseCustomerAlgo == "" {
+			sseCustomerAlgo = "AES256"
+		}
+		rawKey, err := base64.StdEncoding.DecodeString(sseCustomerKey)
+		if err != nil {
+			return Config{}, errors.Wrapf(err, "sse_customer_key must be base64-encoded")
+		}
+		sum := md5.Sum(rawKey) //nolint:gosec // required by the S3 SSE-C API, not used for security purposes
+		sseCustomerKeyMD5 = base64.StdEncoding.EncodeToString(sum[:])
+	}
+
+	bucketKeyEnabled := false
+	bucketKeyEnabledStr, ok := attrs[attrBucketKeyEnabled]
+	if ok {
+		bucketKeyEnabledUser, err := strconv.ParseBool(bucketKeyEnabledStr)
+		if err == nil {
+			bucketKeyEnabled = bucketKeyEnabledUser
+		}
+	}
+
+	blobsStorageClass := attrs[attrBlobsStorageClass]
+	if blobsStorageClass == "" {
+		blobsStorageClass = attrs[attrStorageClass]
+	}
+	manifestStorageClass := attrs[attrManifestStorageClass]
+	if manifestStorageClass == "" {
+		manifestStorageClass = attrs[attrStorageClass]
+	}
+	objectTags := attrs[attrObjectTags]
+
+	manifestMode := attrs[attrManifestMode]
+	switch manifestMode {
+	case "", manifestModeVersioned:
+	default:
+		return Config{}, errors.Errorf("manifest_mode must be %q or empty", manifestModeVersioned)
+	}
+
+	importManifestVersion := attrs[attrImportManifestVersion]
+
+	manifestHistoryKeep := 0
+	manifestHistoryKeepStr, ok := attrs[attrManifestHistoryKeep]
+	if ok {
+		manifestHistoryKeepInt, err := strconv.Atoi(manifestHistoryKeepStr)
+		if err != nil || manifestHistoryKeepInt < 0 {
+			return Config{}, errors.Errorf("manifest_history_keep must be a non-negative integer")
+		}
+		manifestHistoryKeep = manifestHistoryKeepInt
+	}
+
 	return Config{
-		Bucket:            bucket,
-		Region:            region,
-		Prefix:            prefix,
-		ManifestsPrefix:   manifestsPrefix,
-		BlobsPrefix:       blobsPrefix,
-		Names:             names,
-		TouchRefresh:      touchRefresh,
-		EndpointURL:       endpointURL,
-		AccessKeyID:       accessKeyID,
-		SecretAccessKey:   secretAccessKey,
-		SessionToken:      sessionToken,
-		UsePathStyle:      usePathStyle,
-		UploadParallelism: uploadParallelism,
+		Bucket:                bucket,
+		Region:                region,
+		Prefix:                prefix,
+		ManifestsPrefix:       manifestsPrefix,
+		BlobsPrefix:           blobsPrefix,
+		Names:                 names,
+		TouchRefresh:          touchRefresh,
+		EndpointURL:           endpointURL,
+		AccessKeyID:           accessKeyID,
+		SecretAccessKey:       secretAccessKey,
+		SessionToken:          sessionToken,
+		UsePathStyle:          usePathStyle,
+		UploadParallelism:     uploadParallelism,
+		SSE:                   sse,
+		SSEKMSKeyID:           sseKMSKeyID,
+		SSECustomerAlgo:       sseCustomerAlgo,
+		SSECustomerKey:        sseCustomerKey,
+		SSECustomerKeyMD5:     sseCustomerKeyMD5,
+		BucketKeyEnabled:      bucketKeyEnabled,
+		BlobsStorageClass:     blobsStorageClass,
+		ManifestStorageClass:  manifestStorageClass,
+		ObjectTags:            objectTags,
+		ManifestMode:          manifestMode,
+		ImportManifestVersion: importManifestVersion,
+		ManifestHistoryKeep:   manifestHistoryKeep,
+		DownloadParallelism:   downloadParallelism,
+		PartSize:              partSize,
+		RoleARN:               roleARN,
+		RoleSessionName:       roleSessionName,
+		ExternalID:            externalID,
+		WebIdentityTokenFile:  webIdentityTokenFile,
+		Profile:               profile,
+		Checksum:              checksum,
+		Provider:              provider,
+		DisableContentMD5:     disableContentMD5,
 	}, nil
 }
 
@@ -255,7 +476,7 @@ func (e *exporter) Finalize(ctx context.Context) (map[string]string, error) {
 						return layerDone(errors.Wrap(err, "error reading layer blob from provider"))
 					}
 					defer ra.Close()
-					if err := e.s3Client.saveMutableAt(groupCtx, key, &nopCloserSectionReader{io.NewSectionReader(ra, 0, ra.Size())}); err != nil {
+					if err := e.s3Client.saveMutableAt(groupCtx, key, &nopCloserSectionReader{io.NewSectionReader(ra, 0, ra.Size())}, e.s3Client.blobsStorageClass, ""); err != nil {
 						return layerDone(errors.Wrap(err, "error writing layer blob"))
 					}
 					layerDone(nil)
@@ -289,7 +510,13 @@ func (e *exporter) Finalize(ctx context.Context) (map[string]string, error) {
 	}
 
 	for _, name := range e.config.Names {
-		if err := e.s3Client.saveMutableAt(ctx, e.s3Client.manifestKey(name), bytes.NewReader(dt)); err != nil {
+		if e.config.ManifestMode == manifestModeVersioned {
+			if err := e.s3Client.saveManifestVersioned(ctx, name, dt); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := e.s3Client.saveMutableAt(ctx, e.s3Client.manifestKey(name), bytes.NewReader(dt), e.s3Client.manifestStorageClass, contentMD5(dt)); err != nil {
 			return nil, errors.Wrapf(err, "error writing manifest: %s", name)
 		}
 	}
@@ -344,8 +571,16 @@ func (i *importer) makeDescriptorProviderPair(l v1.CacheLayer) (*v1.DescriptorPr
 }
 
 func (i *importer) load(ctx context.Context) (*v1.CacheChains, error) {
+	key, found, err := i.s3Client.resolveManifestKey(ctx, i.config.Names[0])
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return v1.NewCacheChains(), nil
+	}
+
 	var config v1.CacheConfig
-	found, err := i.s3Client.getManifest(ctx, i.s3Client.manifestKey(i.config.Names[0]), &config)
+	found, err = i.s3Client.getManifest(ctx, key, &config)
 	if err != nil {
 		return nil, err
 	}
@@ -384,31 +619,93 @@ func (i *importer) Resolve(ctx context.Context, _ ocispecs.Descriptor, id string
 	return solver.NewCacheManager(ctx, id, keysStorage, resultStorage), nil
 }
 
-type readerAt struct {
-	ReaderAtCloser
-	size int64
-}
-
-func (r *readerAt) Size() int64 {
-	return r.size
-}
-
 type s3Client struct {
 	*s3.Client
 	*manager.Uploader
-	bucket          string
-	prefix          string
-	blobsPrefix     string
-	manifestsPrefix string
+	*manager.Downloader
+	bucket                string
+	prefix                string
+	blobsPrefix           string
+	manifestsPrefix       string
+	sse                   string
+	sseKMSKeyID           string
+	sseCustomerAlgo       string
+	sseCustomerKey        string
+	sseCustomerMD5        string
+	bucketKeyEnabled      bool
+	blobsStorageClass     string
+	manifestStorageClass  string
+	objectTags            string
+	manifestMode          string
+	importManifestVersion string
+	manifestHistoryKeep   int
+	checksum              string
+	provider              string
+	disableContentMD5     bool
+}
+
+// refreshCredentialsLoop periodically retrieves from credsCache so that
+// role credentials are renewed ahead of expiry rather than on-demand.
+func refreshCredentialsLoop(ctx context.Context, credsCache *aws.CredentialsCache) {
+	ticker := time.NewTicker(credentialsRefreshTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			credsCache.Retrieve(ctx) //nolint:errcheck // best-effort warm-up; real errors surface on the next request
+		}
+	}
 }
 
 func newS3Client(ctx context.Context, config Config) (*s3Client, error) {
-	cfg, err := aws_config.LoadDefaultConfig(ctx, aws_config.WithRegion(config.Region))
+	var configOpts []func(*aws_config.LoadOptions) error
+	configOpts = append(configOpts, aws_config.WithRegion(config.Region))
+	if config.Profile != "" {
+		configOpts = append(configOpts, aws_config.WithSharedConfigProfile(config.Profile))
+	}
+
+	cfg, err := aws_config.LoadDefaultConfig(ctx, configOpts...)
 	if err != nil {
 		return nil, errors.Errorf("Unable to load AWS SDK config, %v", err)
 	}
+
+	var credsCache *aws.CredentialsCache
+	if config.RoleARN != "" {
+		stsClient := sts.NewFromConfig(cfg, func(options *sts.Options) {
+			// If static credentials were also supplied, assume the role from
+			// them rather than from the default credential chain, so that
+			// e.g. long-lived CI secrets can be used to assume a short-lived role.
+			if config.AccessKeyID != "" && config.SecretAccessKey != "" {
+				options.Credentials = credentials.NewStaticCredentialsProvider(config.AccessKeyID, config.SecretAccessKey, config.SessionToken)
+			}
+		})
+		var provider aws.CredentialsProvider
+		if config.WebIdentityTokenFile != "" {
+			provider = stscreds.NewWebIdentityRoleProvider(stsClient, config.RoleARN, stscreds.IdentityTokenFile(config.WebIdentityTokenFile), func(o *stscreds.WebIdentityRoleOptions) {
+				o.RoleSessionName = config.RoleSessionName
+			})
+		} else {
+			provider = stscreds.NewAssumeRoleProvider(stsClient, config.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+				o.RoleSessionName = config.RoleSessionName
+				if config.ExternalID != "" {
+					o.ExternalID = &config.ExternalID
+				}
+			})
+		}
+		credsCache = aws.NewCredentialsCache(provider, func(o *aws.CredentialsCacheOptions) {
+			// Treat credentials as expired one refresh tick early, so that
+			// refreshCredentialsLoop renews them before they actually expire.
+			o.ExpiryWindow = credentialsRefreshTick
+		})
+	}
+
 	client := s3.NewFromConfig(cfg, func(options *s3.Options) {
-		if config.AccessKeyID != "" && config.SecretAccessKey != "" {
+		switch {
+		case credsCache != nil:
+			options.Credentials = credsCache
+		case config.AccessKeyID != "" && config.SecretAccessKey != "":
 			options.Credentials = credentials.NewStaticCredentialsProvider(config.AccessKeyID, config.SecretAccessKey, config.SessionToken)
 		}
 		if config.EndpointURL != "" {
@@ -417,13 +714,41 @@ func newS3Client(ctx context.Context, config Config) (*s3Client, error) {
 		}
 	})
 
+	if credsCache != nil {
+		// Long-lived buildkitd processes must proactively refresh short-lived
+		// role credentials (IRSA / CI OIDC federation) so a multi-hour cache
+		// import/export doesn't fail mid-upload on expiry.
+		go refreshCredentialsLoop(ctx, credsCache)
+	}
+
+	downloader := manager.NewDownloader(client, func(d *manager.Downloader) {
+		d.Concurrency = config.DownloadParallelism
+		d.PartSize = config.PartSize
+	})
+
 	return &s3Client{
-		Client:          client,
-		Uploader:        manager.NewUploader(client),
-		bucket:          config.Bucket,
-		prefix:          config.Prefix,
-		blobsPrefix:     config.BlobsPrefix,
-		manifestsPrefix: config.ManifestsPrefix,
+		Client:                client,
+		Uploader:              manager.NewUploader(client),
+		Downloader:            downloader,
+		bucket:                config.Bucket,
+		prefix:                config.Prefix,
+		blobsPrefix:           config.BlobsPrefix,
+		manifestsPrefix:       config.ManifestsPrefix,
+		sse:                   config.SSE,
+		sseKMSKeyID:           config.SSEKMSKeyID,
+		sseCustomerAlgo:       config.SSECustomerAlgo,
+		sseCustomerKey:        config.SSECustomerKey,
+		sseCustomerMD5:        config.SSECustomerKeyMD5,
+		bucketKeyEnabled:      config.BucketKeyEnabled,
+		blobsStorageClass:     config.BlobsStorageClass,
+		manifestStorageClass:  config.ManifestStorageClass,
+		objectTags:            config.ObjectTags,
+		manifestMode:          config.ManifestMode,
+		importManifestVersion: config.ImportManifestVersion,
+		manifestHistoryKeep:   config.ManifestHistoryKeep,
+		checksum:              config.Checksum,
+		provider:              config.Provider,
+		disableContentMD5:     config.DisableContentMD5,
 	}, nil
 }
 
@@ -432,6 +757,8 @@ func (s3Client *s3Client) getManifest(ctx context.Context, key string, config *v
 		Bucket: &s3Client.bucket,
 		Key:    &key,
 	}
+	s3Client.applySSECustomerGet(input)
+	s3Client.applyChecksumModeGet(input)
 
 	output, err := s3Client.GetObject(ctx, input)
 	if err != nil {
@@ -453,14 +780,13 @@ func (s3Client *s3Client) getManifest(ctx context.Context, key string, config *v
 	return true, nil
 }
 
-func (s3Client *s3Client) getReader(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+func (s3Client *s3Client) getReader(ctx context.Context, key string) (io.ReadCloser, error) {
 	input := &s3.GetObjectInput{
 		Bucket: &s3Client.bucket,
 		Key:    &key,
 	}
-	if offset > 0 {
-		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
-	}
+	s3Client.applyChecksumModeGet(input)
+	s3Client.applySSECustomerGet(input)
 
 	output, err := s3Client.GetObject(ctx, input)
 	if err != nil {
@@ -469,21 +795,128 @@ func (s3Client *s3Client) getReader(ctx context.Context, key string, offset int6
 	return output.Body, nil
 }
 
-func (s3Client *s3Client) saveMutableAt(ctx context.Context, key string, body io.Reader) error {
+// applyChecksumModeGet asks S3 to validate the object's additional checksum
+// (if any) and return it, so the SDK rejects a corrupted response.
+func (s3Client *s3Client) applyChecksumModeGet(input *s3.GetObjectInput) {
+	if s3Client.checksum == "off" {
+		return
+	}
+	input.ChecksumMode = s3types.ChecksumModeEnabled
+}
+
+func (s3Client *s3Client) saveMutableAt(ctx context.Context, key string, body io.Reader, storageClass, contentMD5 string) error {
 	input := &s3.PutObjectInput{
 		Bucket: &s3Client.bucket,
 		Key:    &key,
 		Body:   body,
 	}
+	if storageClass != "" {
+		input.StorageClass = s3types.StorageClass(storageClass)
+	}
+	if s3Client.objectTags != "" {
+		input.Tagging = &s3Client.objectTags
+	}
+	input.ChecksumAlgorithm = checksumAlgorithmFor(s3Client.checksum)
+	if wantsContentMD5(contentMD5, s3Client.disableContentMD5, input.ChecksumAlgorithm) {
+		input.ContentMD5 = &contentMD5
+	}
+	s3Client.applySSEPut(input)
 	_, err := s3Client.Upload(ctx, input)
 	return err
 }
 
+// checksumAlgorithmFor maps the checksum config value to the S3 additional
+// checksum algorithm to request on upload, if any.
+func checksumAlgorithmFor(checksum string) s3types.ChecksumAlgorithm {
+	switch checksum {
+	case "sha256":
+		return s3types.ChecksumAlgorithmSha256
+	case "crc32c":
+		return s3types.ChecksumAlgorithmCrc32c
+	default:
+		return ""
+	}
+}
+
+// wantsContentMD5 reports whether a PutObjectInput should carry the
+// Content-MD5 header. Content-MD5 and an additional checksum algorithm are
+// redundant integrity mechanisms, so Content-MD5 is only sent when no
+// checksum algorithm is set, to avoid pairing a whole-body MD5 header with a
+// trailing-checksum upload.
+func wantsContentMD5(contentMD5 string, disableContentMD5 bool, algo s3types.ChecksumAlgorithm) bool {
+	return contentMD5 != "" && !disableContentMD5 && algo == ""
+}
+
+// contentMD5 returns the base64-encoded MD5 digest of dt, as required by
+// the S3 Content-MD5 header.
+func contentMD5(dt []byte) string {
+	sum := md5.Sum(dt) //nolint:gosec // required by the S3 Content-MD5 header, not used for security purposes
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// applySSEPut sets the destination server-side-encryption headers on a PutObjectInput.
+func (s3Client *s3Client) applySSEPut(input *s3.PutObjectInput) {
+	if s3Client.sse != "" {
+		input.ServerSideEncryption = s3types.ServerSideEncryption(s3Client.sse)
+		if s3Client.sseKMSKeyID != "" {
+			input.SSEKMSKeyId = &s3Client.sseKMSKeyID
+		}
+		if s3Client.bucketKeyEnabled {
+			input.BucketKeyEnabled = aws.Bool(true)
+		}
+	}
+	if s3Client.sseCustomerKey != "" {
+		input.SSECustomerAlgorithm = &s3Client.sseCustomerAlgo
+		input.SSECustomerKey = &s3Client.sseCustomerKey
+		input.SSECustomerKeyMD5 = &s3Client.sseCustomerMD5
+	}
+}
+
+// applySSECustomerGet sets the SSE-C headers required to read an object encrypted with a customer-provided key.
+func (s3Client *s3Client) applySSECustomerGet(input *s3.GetObjectInput) {
+	if s3Client.sseCustomerKey == "" {
+		return
+	}
+	input.SSECustomerAlgorithm = &s3Client.sseCustomerAlgo
+	input.SSECustomerKey = &s3Client.sseCustomerKey
+	input.SSECustomerKeyMD5 = &s3Client.sseCustomerMD5
+}
+
+// applySSECustomerHead sets the SSE-C headers required to HEAD an object encrypted with a customer-provided key.
+func (s3Client *s3Client) applySSECustomerHead(input *s3.HeadObjectInput) {
+	if s3Client.sseCustomerKey == "" {
+		return
+	}
+	input.SSECustomerAlgorithm = &s3Client.sseCustomerAlgo
+	input.SSECustomerKey = &s3Client.sseCustomerKey
+	input.SSECustomerKeyMD5 = &s3Client.sseCustomerMD5
+}
+
+// supportsCopyObject reports whether the configured backend reliably
+// supports CopyObject with MetadataDirective=REPLACE. Some S3-compatible
+// backends (R2, GCS's XML API) do not, so touch must fall back to writing
+// a small marker object instead of copying the blob in place.
+func (s3Client *s3Client) supportsCopyObject() bool {
+	switch s3Client.provider {
+	case providerCloudflareR2, providerGCSHMAC:
+		return false
+	default:
+		return true
+	}
+}
+
+// touchMarkerKey is the key of the small sentinel object used to record a
+// touch when the backend does not support an efficient CopyObject.
+func (s3Client *s3Client) touchMarkerKey(key string) string {
+	return key + ".touch"
+}
+
 func (s3Client *s3Client) exists(ctx context.Context, key string) (*time.Time, *int64, error) {
 	input := &s3.HeadObjectInput{
 		Bucket: &s3Client.bucket,
 		Key:    &key,
 	}
+	s3Client.applySSECustomerHead(input)
 
 	head, err := s3Client.HeadObject(ctx, input)
 	if err != nil {
@@ -492,7 +925,23 @@ func (s3Client *s3Client) exists(ctx context.Context, key string) (*time.Time, *
 		}
 		return nil, nil, err
 	}
-	return head.LastModified, head.ContentLength, nil
+	lastModified := head.LastModified
+
+	if !s3Client.supportsCopyObject() {
+		markerKey := s3Client.touchMarkerKey(key)
+		markerHead, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: &s3Client.bucket,
+			Key:    &markerKey,
+		})
+		if err != nil && !isNotFound(err) {
+			return nil, nil, err
+		}
+		if err == nil && markerHead.LastModified != nil && (lastModified == nil || markerHead.LastModified.After(*lastModified)) {
+			lastModified = markerHead.LastModified
+		}
+	}
+
+	return lastModified, head.ContentLength, nil
 }
 
 func buildCopySourceRange(start int64, objectSize int64) string {
@@ -506,6 +955,11 @@ func buildCopySourceRange(start int64, objectSize int64) string {
 }
 
 func (s3Client *s3Client) touch(ctx context.Context, key string, size *int64) (err error) {
+	if !s3Client.supportsCopyObject() {
+		markerKey := s3Client.touchMarkerKey(key)
+		return s3Client.saveMutableAt(ctx, markerKey, strings.NewReader(time.Now().UTC().Format(time.RFC3339Nano)), s3Client.blobsStorageClass, "")
+	}
+
 	copySource := fmt.Sprintf("%s/%s", s3Client.bucket, key)
 
 	// CopyObject does not support files > 5GB
@@ -517,6 +971,17 @@ func (s3Client *s3Client) touch(ctx context.Context, key string, size *int64) (e
 			Metadata:          map[string]string{"updated-at": time.Now().String()},
 			MetadataDirective: "REPLACE",
 		}
+		// S3 does not preserve SSE settings, storage class or tags across a
+		// CopyObject with MetadataDirective=REPLACE, so they must be re-applied explicitly.
+		if s3Client.blobsStorageClass != "" {
+			cp.StorageClass = s3types.StorageClass(s3Client.blobsStorageClass)
+		}
+		if s3Client.objectTags != "" {
+			cp.Tagging = &s3Client.objectTags
+			cp.TaggingDirective = "REPLACE"
+		}
+		s3Client.applySSECopyDestination(cp)
+		s3Client.applySSECopySource(cp)
 
 		_, err := s3Client.CopyObject(ctx, cp)
 
@@ -526,6 +991,13 @@ func (s3Client *s3Client) touch(ctx context.Context, key string, size *int64) (e
 		Bucket: &s3Client.bucket,
 		Key:    &key,
 	}
+	if s3Client.blobsStorageClass != "" {
+		input.StorageClass = s3types.StorageClass(s3Client.blobsStorageClass)
+	}
+	if s3Client.objectTags != "" {
+		input.Tagging = &s3Client.objectTags
+	}
+	s3Client.applySSEMultipartCreate(input)
 
 	output, err := s3Client.CreateMultipartUpload(ctx, input)
 	if err != nil {
@@ -557,6 +1029,7 @@ func (s3Client *s3Client) touch(ctx context.Context, key string, size *int64) (e
 			PartNumber:      &currentPartNumber,
 			UploadId:        output.UploadId,
 		}
+		s3Client.applySSEUploadPartCopySource(&partInput)
 		uploadPartCopyResult, err := s3Client.UploadPartCopy(ctx, &partInput)
 		if err != nil {
 			return err
@@ -588,17 +1061,260 @@ func (s3Client *s3Client) touch(ctx context.Context, key string, size *int64) (e
 	return nil
 }
 
+// applySSECopyDestination sets the encryption headers for the copy of a touched object.
+func (s3Client *s3Client) applySSECopyDestination(input *s3.CopyObjectInput) {
+	if s3Client.sse != "" {
+		input.ServerSideEncryption = s3types.ServerSideEncryption(s3Client.sse)
+		if s3Client.sseKMSKeyID != "" {
+			input.SSEKMSKeyId = &s3Client.sseKMSKeyID
+		}
+		if s3Client.bucketKeyEnabled {
+			input.BucketKeyEnabled = aws.Bool(true)
+		}
+	}
+	if s3Client.sseCustomerKey != "" {
+		input.SSECustomerAlgorithm = &s3Client.sseCustomerAlgo
+		input.SSECustomerKey = &s3Client.sseCustomerKey
+		input.SSECustomerKeyMD5 = &s3Client.sseCustomerMD5
+	}
+}
+
+// applySSECopySource sets the SSE-C headers needed to read a source object encrypted with a customer-provided key.
+func (s3Client *s3Client) applySSECopySource(input *s3.CopyObjectInput) {
+	if s3Client.sseCustomerKey == "" {
+		return
+	}
+	input.CopySourceSSECustomerAlgorithm = &s3Client.sseCustomerAlgo
+	input.CopySourceSSECustomerKey = &s3Client.sseCustomerKey
+	input.CopySourceSSECustomerKeyMD5 = &s3Client.sseCustomerMD5
+}
+
+// applySSEUploadPartCopySource sets the SSE-C headers needed by UploadPartCopy on both ends of the copy.
+func (s3Client *s3Client) applySSEUploadPartCopySource(input *s3.UploadPartCopyInput) {
+	if s3Client.sseCustomerKey == "" {
+		return
+	}
+	input.SSECustomerAlgorithm = &s3Client.sseCustomerAlgo
+	input.SSECustomerKey = &s3Client.sseCustomerKey
+	input.SSECustomerKeyMD5 = &s3Client.sseCustomerMD5
+	input.CopySourceSSECustomerAlgorithm = &s3Client.sseCustomerAlgo
+	input.CopySourceSSECustomerKey = &s3Client.sseCustomerKey
+	input.CopySourceSSECustomerKeyMD5 = &s3Client.sseCustomerMD5
+}
+
+// applySSEMultipartCreate sets the destination encryption headers for a multipart touch of a large object.
+func (s3Client *s3Client) applySSEMultipartCreate(input *s3.CreateMultipartUploadInput) {
+	if s3Client.sse != "" {
+		input.ServerSideEncryption = s3types.ServerSideEncryption(s3Client.sse)
+		if s3Client.sseKMSKeyID != "" {
+			input.SSEKMSKeyId = &s3Client.sseKMSKeyID
+		}
+		if s3Client.bucketKeyEnabled {
+			input.BucketKeyEnabled = aws.Bool(true)
+		}
+	}
+	if s3Client.sseCustomerKey != "" {
+		input.SSECustomerAlgorithm = &s3Client.sseCustomerAlgo
+		input.SSECustomerKey = &s3Client.sseCustomerKey
+		input.SSECustomerKeyMD5 = &s3Client.sseCustomerMD5
+	}
+}
+
+// fileReaderAt serves ReadAt from a blob that has already been fully
+// downloaded and digest-verified into a spooled temp file, so that large
+// layer blobs don't have to be held in memory for the lifetime of the read.
+type fileReaderAt struct {
+	f    *os.File
+	size int64
+}
+
+func (r *fileReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return r.f.ReadAt(p, off)
+}
+
+func (r *fileReaderAt) Size() int64 {
+	return r.size
+}
+
+func (r *fileReaderAt) Close() error {
+	name := r.f.Name()
+	closeErr := r.f.Close()
+	if err := os.Remove(name); err != nil && closeErr == nil {
+		return err
+	}
+	return closeErr
+}
+
+// ReaderAt downloads the blob using a concurrent multipart download into a
+// spooled temp file and verifies the content against desc.Digest before
+// serving it, since S3 does not itself validate object bodies against
+// object keys. The temp file keeps memory use bounded for large compressed
+// layer blobs instead of buffering the whole object in RAM.
 func (s3Client *s3Client) ReaderAt(ctx context.Context, desc ocispecs.Descriptor) (content.ReaderAt, error) {
-	readerAtCloser := toReaderAtCloser(func(offset int64) (io.ReadCloser, error) {
-		return s3Client.getReader(ctx, s3Client.blobKey(desc.Digest), offset)
-	})
-	return &readerAt{ReaderAtCloser: readerAtCloser, size: desc.Size}, nil
+	key := s3Client.blobKey(desc.Digest)
+	getInput := &s3.GetObjectInput{
+		Bucket: &s3Client.bucket,
+		Key:    &key,
+	}
+	s3Client.applySSECustomerGet(getInput)
+
+	f, err := os.CreateTemp("", "buildkit-s3-cache-blob-*")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create temp file for blob download")
+	}
+	removeOnErr := func() { os.Remove(f.Name()) }
+
+	if _, err := s3Client.Download(ctx, f, getInput); err != nil {
+		f.Close()
+		removeOnErr()
+		return nil, errors.Wrapf(err, "failed to download blob %s", desc.Digest)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		removeOnErr()
+		return nil, errors.Wrap(err, "failed to seek downloaded blob")
+	}
+	verifier := desc.Digest.Verifier()
+	if _, err := io.Copy(verifier, f); err != nil {
+		f.Close()
+		removeOnErr()
+		return nil, errors.Wrap(err, "failed to verify downloaded blob")
+	}
+	if !verifier.Verified() {
+		f.Close()
+		removeOnErr()
+		return nil, errors.Errorf("digest mismatch for blob %s", desc.Digest)
+	}
+
+	return &fileReaderAt{f: f, size: desc.Size}, nil
 }
 
 func (s3Client *s3Client) manifestKey(name string) string {
 	return s3Client.prefix + s3Client.manifestsPrefix + name
 }
 
+// manifestVersionsPrefix returns the S3 key prefix under which versioned
+// manifests and the CURRENT pointer for name are stored.
+func (s3Client *s3Client) manifestVersionsPrefix(name string) string {
+	return s3Client.manifestKey(name) + "/"
+}
+
+func (s3Client *s3Client) manifestPointerKey(name string) string {
+	return s3Client.manifestVersionsPrefix(name) + manifestCurrentKey
+}
+
+func (s3Client *s3Client) manifestVersionKey(name, version string) string {
+	return s3Client.manifestVersionsPrefix(name) + version + ".json"
+}
+
+// newManifestVersion generates a lexicographically sortable, unique
+// version identifier for a versioned manifest export.
+func newManifestVersion() (string, error) {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", errors.Wrap(err, "failed to generate manifest version")
+	}
+	return fmt.Sprintf("%019d-%s", time.Now().UTC().UnixNano(), hex.EncodeToString(buf[:])), nil
+}
+
+// saveManifestVersioned writes a new manifest version and atomically
+// repoints CURRENT at it, then prunes old versions beyond manifestHistoryKeep.
+func (s3Client *s3Client) saveManifestVersioned(ctx context.Context, name string, dt []byte) error {
+	version, err := newManifestVersion()
+	if err != nil {
+		return err
+	}
+	versionKey := s3Client.manifestVersionKey(name, version)
+	if err := s3Client.saveMutableAt(ctx, versionKey, bytes.NewReader(dt), s3Client.manifestStorageClass, contentMD5(dt)); err != nil {
+		return errors.Wrapf(err, "error writing manifest version: %s", version)
+	}
+	if err := s3Client.saveMutableAt(ctx, s3Client.manifestPointerKey(name), strings.NewReader(version), s3Client.manifestStorageClass, contentMD5([]byte(version))); err != nil {
+		return errors.Wrapf(err, "error updating CURRENT pointer for manifest: %s", name)
+	}
+	if s3Client.manifestHistoryKeep > 0 {
+		if err := s3Client.pruneManifestVersions(ctx, name, s3Client.manifestHistoryKeep); err != nil {
+			return errors.Wrapf(err, "error pruning old manifest versions: %s", name)
+		}
+	}
+	return nil
+}
+
+// pruneManifestVersions deletes all but the keep newest manifest versions for name.
+func (s3Client *s3Client) pruneManifestVersions(ctx context.Context, name string, keep int) error {
+	prefix := s3Client.manifestVersionsPrefix(name)
+	pointerKey := s3Client.manifestPointerKey(name)
+
+	var versions []string
+	var continuationToken *string
+	for {
+		output, err := s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:            &s3Client.bucket,
+			Prefix:            &prefix,
+			ContinuationToken: continuationToken,
+		})
+		if err != nil {
+			return err
+		}
+		for _, obj := range output.Contents {
+			if obj.Key == nil || *obj.Key == pointerKey {
+				continue
+			}
+			versions = append(versions, *obj.Key)
+		}
+		if !aws.ToBool(output.IsTruncated) {
+			break
+		}
+		continuationToken = output.NextContinuationToken
+	}
+
+	for _, key := range manifestVersionsToPrune(versions, keep) {
+		key := key
+		if _, err := s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: &s3Client.bucket,
+			Key:    &key,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// manifestVersionsToPrune returns the versions to delete so that only the
+// keep newest remain. Keys are prefixed with a zero-padded nanosecond
+// timestamp, so they sort chronologically.
+func manifestVersionsToPrune(versions []string, keep int) []string {
+	sort.Strings(versions)
+	if len(versions) <= keep {
+		return nil
+	}
+	return versions[:len(versions)-keep]
+}
+
+// resolveManifestKey returns the S3 key that should be read for name,
+// honoring manifest_mode and import_manifest_version.
+func (s3Client *s3Client) resolveManifestKey(ctx context.Context, name string) (string, bool, error) {
+	if s3Client.manifestMode != manifestModeVersioned {
+		return s3Client.manifestKey(name), true, nil
+	}
+	if s3Client.importManifestVersion != "" {
+		return s3Client.manifestVersionKey(name, s3Client.importManifestVersion), true, nil
+	}
+	reader, err := s3Client.getReader(ctx, s3Client.manifestPointerKey(name))
+	if err != nil {
+		if isNotFound(err) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	defer reader.Close()
+	version, err := io.ReadAll(reader)
+	if err != nil {
+		return "", false, errors.Wrap(err, "failed to read CURRENT manifest pointer")
+	}
+	return s3Client.manifestVersionKey(name, string(version)), true, nil
+}
+
 func (s3Client *s3Client) blobKey(dgst digest.Digest) string {
 	return s3Client.prefix + s3Client.blobsPrefix + dgst.String()
 }
@@ -0,0 +1,176 @@
+package s3
+
+import (
+	"testing"
+
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifestKeyHelpers(t *testing.T) {
+	c := &s3Client{prefix: "cache/", manifestsPrefix: "manifests/"}
+
+	require.Equal(t, "cache/manifests/buildkit", c.manifestKey("buildkit"))
+	require.Equal(t, "cache/manifests/buildkit/", c.manifestVersionsPrefix("buildkit"))
+	require.Equal(t, "cache/manifests/buildkit/CURRENT", c.manifestPointerKey("buildkit"))
+	require.Equal(t, "cache/manifests/buildkit/v1.json", c.manifestVersionKey("buildkit", "v1"))
+}
+
+func TestNewManifestVersionIsSortableAndUnique(t *testing.T) {
+	v1, err := newManifestVersion()
+	require.NoError(t, err)
+	v2, err := newManifestVersion()
+	require.NoError(t, err)
+
+	require.NotEqual(t, v1, v2)
+	require.Len(t, v1, 19+1+16)
+}
+
+func baseAttrs() map[string]string {
+	return map[string]string{
+		attrBucket: "my-bucket",
+		attrRegion: "us-east-1",
+	}
+}
+
+func TestGetConfigRoleDefaults(t *testing.T) {
+	attrs := baseAttrs()
+	attrs[attrRoleARN] = "arn:aws:iam::123456789012:role/cache"
+
+	cfg, err := getConfig(attrs)
+	require.NoError(t, err)
+	require.Equal(t, "buildkit", cfg.RoleSessionName)
+	require.Empty(t, cfg.ExternalID)
+	require.Empty(t, cfg.WebIdentityTokenFile)
+	require.Empty(t, cfg.Profile)
+}
+
+func TestGetConfigRoleAttrs(t *testing.T) {
+	attrs := baseAttrs()
+	attrs[attrRoleARN] = "arn:aws:iam::123456789012:role/cache"
+	attrs[attrRoleSessionName] = "my-session"
+	attrs[attrExternalID] = "my-external-id"
+	attrs[attrWebIdentityTokenFile] = "/var/run/token"
+	attrs[attrProfile] = "my-profile"
+
+	cfg, err := getConfig(attrs)
+	require.NoError(t, err)
+	require.Equal(t, "arn:aws:iam::123456789012:role/cache", cfg.RoleARN)
+	require.Equal(t, "my-session", cfg.RoleSessionName)
+	require.Equal(t, "my-external-id", cfg.ExternalID)
+	require.Equal(t, "/var/run/token", cfg.WebIdentityTokenFile)
+	require.Equal(t, "my-profile", cfg.Profile)
+}
+
+func TestGetConfigChecksumDefault(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		provider string
+		want     string
+	}{
+		{name: "empty provider defaults to sha256", provider: "", want: "sha256"},
+		{name: "aws defaults to sha256", provider: providerAWS, want: "sha256"},
+		{name: "minio defaults to off", provider: providerMinIO, want: "off"},
+		{name: "ceph defaults to off", provider: providerCeph, want: "off"},
+		{name: "cloudflare-r2 defaults to off", provider: providerCloudflareR2, want: "off"},
+		{name: "gcs-hmac defaults to off", provider: providerGCSHMAC, want: "off"},
+		{name: "other defaults to off", provider: providerOther, want: "off"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			attrs := baseAttrs()
+			attrs[attrProvider] = tt.provider
+
+			cfg, err := getConfig(attrs)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, cfg.Checksum)
+		})
+	}
+}
+
+func TestGetConfigChecksumExplicit(t *testing.T) {
+	attrs := baseAttrs()
+	attrs[attrProvider] = providerMinIO
+	attrs[attrChecksum] = "crc32c"
+
+	cfg, err := getConfig(attrs)
+	require.NoError(t, err)
+	require.Equal(t, "crc32c", cfg.Checksum)
+}
+
+func TestGetConfigChecksumInvalid(t *testing.T) {
+	attrs := baseAttrs()
+	attrs[attrChecksum] = "md5"
+
+	_, err := getConfig(attrs)
+	require.Error(t, err)
+}
+
+func TestGetConfigSSEMutuallyExclusive(t *testing.T) {
+	attrs := baseAttrs()
+	attrs[attrSSE] = "AES256"
+	attrs[attrSSECustomerKey] = "c29tZWtleQ=="
+
+	_, err := getConfig(attrs)
+	require.Error(t, err)
+}
+
+func TestGetConfigDisableContentMD5(t *testing.T) {
+	attrs := baseAttrs()
+	attrs[attrDisableContentMD5] = "true"
+
+	cfg, err := getConfig(attrs)
+	require.NoError(t, err)
+	require.True(t, cfg.DisableContentMD5)
+}
+
+func TestChecksumAlgorithmFor(t *testing.T) {
+	require.Equal(t, s3types.ChecksumAlgorithmSha256, checksumAlgorithmFor("sha256"))
+	require.Equal(t, s3types.ChecksumAlgorithmCrc32c, checksumAlgorithmFor("crc32c"))
+	require.Equal(t, s3types.ChecksumAlgorithm(""), checksumAlgorithmFor("off"))
+	require.Equal(t, s3types.ChecksumAlgorithm(""), checksumAlgorithmFor(""))
+}
+
+func TestWantsContentMD5(t *testing.T) {
+	require.True(t, wantsContentMD5("deadbeef", false, ""))
+	require.False(t, wantsContentMD5("", false, ""))
+	require.False(t, wantsContentMD5("deadbeef", true, ""))
+	require.False(t, wantsContentMD5("deadbeef", false, s3types.ChecksumAlgorithmSha256))
+}
+
+func TestManifestVersionsToPrune(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		versions []string
+		keep     int
+		want     []string
+	}{
+		{
+			name:     "under keep limit",
+			versions: []string{"0000000000000000003-a", "0000000000000000001-b"},
+			keep:     5,
+			want:     nil,
+		},
+		{
+			name:     "keep zero prunes everything",
+			versions: []string{"0000000000000000002-a", "0000000000000000001-b"},
+			keep:     0,
+			want:     []string{"0000000000000000001-b", "0000000000000000002-a"},
+		},
+		{
+			name:     "prunes oldest beyond keep",
+			versions: []string{"0000000000000000003-a", "0000000000000000001-b", "0000000000000000002-c"},
+			keep:     1,
+			want:     []string{"0000000000000000001-b", "0000000000000000002-c"},
+		},
+		{
+			name:     "exactly at keep limit",
+			versions: []string{"0000000000000000002-a", "0000000000000000001-b"},
+			keep:     2,
+			want:     nil,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, manifestVersionsToPrune(tt.versions, tt.keep))
+		})
+	}
+}